@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// allowlist restricts the storage accounts and Event Grid topics from which
+// events are accepted. An empty list of accounts or topics places no
+// restriction on that attribute.
+type allowlist struct {
+	accounts map[string]struct{}
+	topics   map[string]struct{}
+}
+
+func newAllowlist(cfg config) *allowlist {
+	a := &allowlist{
+		accounts: map[string]struct{}{},
+		topics:   map[string]struct{}{},
+	}
+	for _, account := range splitList(cfg.GetSetting("allowedAccounts", "")) {
+		a.accounts[account] = struct{}{}
+	}
+	// Azure resource IDs are case insensitive
+	for _, topic := range splitList(cfg.GetSetting("allowedTopics", "")) {
+		a.topics[strings.ToLower(topic)] = struct{}{}
+	}
+	log.WithField(
+		"allowedAccounts", cfg.GetSetting("allowedAccounts", ""),
+	).WithField(
+		"allowedTopics", cfg.GetSetting("allowedTopics", ""),
+	).Debug("allowlist configured")
+	return a
+}
+
+// check returns an error describing why an event originating from the given
+// account and topic is not allowed, or nil if it is.
+func (a *allowlist) check(account, topic string) error {
+	if err := a.checkAccount(account); err != nil {
+		return err
+	}
+	if len(a.topics) > 0 {
+		if _, ok := a.topics[strings.ToLower(topic)]; !ok {
+			rejectedEvents.Add("topic", 1)
+			return fmt.Errorf(
+				`event grid topic "%s" is not an allowed topic`,
+				topic,
+			)
+		}
+	}
+	return nil
+}
+
+// checkAccount is like check, but for events that do not originate from an
+// Event Grid topic.
+func (a *allowlist) checkAccount(account string) error {
+	if len(a.accounts) > 0 {
+		if _, ok := a.accounts[account]; !ok {
+			rejectedEvents.Add("account", 1)
+			return fmt.Errorf(
+				`storage account "%s" is not an allowed account`,
+				account,
+			)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/2018-03-28/azblob"
+	log "github.com/Sirupsen/logrus"
+	"github.com/faasaf/frameworks/trigger"
+)
+
+// Storage Analytics writes logs for the blob service to the $logs container
+// as blob/<yyyy>/<mm>/<dd>/<hhmm>/<nnnnnn>.log. Because of this naming
+// scheme, listing the container yields log blobs in chronological order.
+// Each line of a log blob is a single semicolon delimited entry. Fields that
+// may contain semicolons are quoted.
+
+const (
+	analyticsLogsContainer = "$logs"
+	analyticsLogsPrefix    = "blob/"
+)
+
+// Indices of the fields of a log entry that are of interest. These are the
+// same in both the version 1.0 and version 2.0 formats; version 2.0 only adds
+// fields at the end of each entry.
+const (
+	logFieldVersion           = 0
+	logFieldOperationType     = 2
+	logFieldRequestStatus     = 3
+	logFieldRequesterAccount  = 8
+	logFieldRequestURL        = 11
+	logFieldRequestID         = 13
+	logFieldRequesterIP       = 15
+	logFieldUserPrincipalName = 35
+	logFieldCountV1           = 30
+	logFieldCountV2           = 38
+)
+
+// analyticsLogsCursor identifies the next log entry to be processed. Line is
+// the number of lines of the log blob that have already been processed.
+type analyticsLogsCursor struct {
+	Blob string `json:"blob"`
+	Line int    `json:"line"`
+}
+
+type analyticsLogsSource struct {
+	containerURL   azblob.ContainerURL
+	route          *route
+	allowlist      *allowlist
+	coordinator    *coordinator
+	checkpoint     checkpointer
+	pollInterval   time.Duration
+	operationTypes map[string]struct{}
+	containers     map[string]struct{}
+	requesters     map[string]struct{}
+	cursor         analyticsLogsCursor
+	ctxCh          chan trigger.ContextWrapper
+}
+
+func newAnalyticsLogsSource(
+	cfg config,
+) (*analyticsLogsSource, error) {
+	serviceURL, err := newServiceURL(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoint, err := newCheckpointer(cfg, serviceURL)
+	if err != nil {
+		return nil, err
+	}
+
+	coordinator, err := newCoordinator(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	pollIntervalStr := cfg.GetSetting("pollInterval", "1m")
+	pollInterval, err := time.ParseDuration(pollIntervalStr)
+	if err != nil {
+		return nil, fmt.Errorf(
+			`the specified poll interval "%s" could not be parsed as a duration`,
+			pollIntervalStr,
+		)
+	}
+
+	operationTypes := splitList(cfg.GetSetting("operationTypes", "GetBlob"))
+	if len(operationTypes) == 0 {
+		return nil, errors.New(
+			"at least one operation type (operationTypes) must be specified",
+		)
+	}
+
+	log.WithField(
+		"operationTypes", operationTypes,
+	).WithField(
+		"containers", cfg.GetSetting("containers", ""),
+	).WithField(
+		"requesters", cfg.GetSetting("requesters", ""),
+	).Debug("storage analytics log filter configured")
+
+	return &analyticsLogsSource{
+		containerURL:   serviceURL.NewContainerURL(analyticsLogsContainer),
+		route:          newRoute(cfg, "analyticsLogs", ""),
+		allowlist:      newAllowlist(cfg),
+		coordinator:    coordinator,
+		checkpoint:     checkpoint,
+		pollInterval:   pollInterval,
+		operationTypes: newSet(operationTypes),
+		containers:     newSet(splitList(cfg.GetSetting("containers", ""))),
+		requesters:     newSet(splitList(cfg.GetSetting("requesters", ""))),
+	}, nil
+}
+
+func (a *analyticsLogsSource) Run(
+	ctxCh chan trigger.ContextWrapper,
+	errCh chan error,
+) error {
+	a.ctxCh = ctxCh
+	if _, err := a.checkpoint.load(&a.cursor); err != nil {
+		return fmt.Errorf("error loading storage analytics log checkpoint: %s", err)
+	}
+	log.WithField(
+		"blob", a.cursor.Blob,
+	).WithField(
+		"line", a.cursor.Line,
+	).Info("reading storage analytics logs")
+	for {
+		if err := a.poll(context.Background()); err != nil {
+			errCh <- fmt.Errorf("error reading storage analytics logs: %s", err)
+		}
+		time.Sleep(a.pollInterval)
+	}
+}
+
+// poll processes all log entries written since the cursor. Storage Analytics
+// may continue to append to the most recent log blob, so processing resumes
+// from the last processed line of the cursor's blob.
+func (a *analyticsLogsSource) poll(ctx context.Context) error {
+	blobs, err := listBlobs(ctx, a.containerURL, analyticsLogsPrefix)
+	if isStorageError(err, azblob.ServiceCodeContainerNotFound) {
+		log.Debug("storage analytics logging is not enabled")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, blob := range blobs {
+		if blob < a.cursor.Blob {
+			continue
+		}
+		if blob != a.cursor.Blob {
+			a.cursor = analyticsLogsCursor{Blob: blob}
+		}
+		if err := a.processBlob(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *analyticsLogsSource) processBlob(ctx context.Context) error {
+	logBytes, err := downloadBlob(ctx, a.containerURL.NewBlobURL(a.cursor.Blob))
+	if err != nil {
+		return err
+	}
+	completeLines := bytes.Count(logBytes, []byte("\n"))
+	scanner := bufio.NewScanner(bytes.NewReader(logBytes))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 0; scanner.Scan(); line++ {
+		if line < a.cursor.Line {
+			continue
+		}
+		// An incomplete final line is still being written; pick it up on the
+		// next poll
+		if line >= completeLines {
+			break
+		}
+		if err := a.processEntry(scanner.Text()); err != nil {
+			return fmt.Errorf(
+				"error processing line %d of %s: %s",
+				line+1,
+				a.cursor.Blob,
+				err,
+			)
+		}
+		a.cursor.Line = line + 1
+		if err := a.checkpoint.save(a.cursor); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func (a *analyticsLogsSource) processEntry(entry string) error {
+	fields := parseLogEntry(entry)
+	switch fields[logFieldVersion] {
+	case "1.0":
+		if len(fields) < logFieldCountV1 {
+			log.WithField(
+				"entry", entry,
+			).Warn("skipped malformed storage analytics log entry")
+			return nil
+		}
+	case "2.0":
+		if len(fields) < logFieldCountV2 {
+			log.WithField(
+				"entry", entry,
+			).Warn("skipped malformed storage analytics log entry")
+			return nil
+		}
+	default:
+		log.WithField(
+			"version", fields[logFieldVersion],
+		).Warn("skipped storage analytics log entry of unsupported version")
+		return nil
+	}
+
+	if _, ok := a.operationTypes[fields[logFieldOperationType]]; !ok {
+		return nil
+	}
+	if len(a.requesters) > 0 && !a.matchesRequester(fields) {
+		return nil
+	}
+
+	blobURL, err := logEntryBlobURL(fields[logFieldRequestURL])
+	if err != nil {
+		log.WithField(
+			"requestUrl", fields[logFieldRequestURL],
+		).WithField(
+			"error", err,
+		).Warn("skipped storage analytics log entry")
+		return nil
+	}
+	matches := blobURLRegex.FindStringSubmatch(blobURL)
+	if matches == nil {
+		log.WithField(
+			"blobUrl", blobURL,
+		).Warn("skipped storage analytics log entry for unrecognized blob URL")
+		return nil
+	}
+	if len(a.containers) > 0 {
+		if _, ok := a.containers[matches[2]]; !ok {
+			return nil
+		}
+	}
+	if err := a.allowlist.checkAccount(matches[1]); err != nil {
+		log.WithField(
+			"blobUrl", blobURL,
+		).WithField(
+			"reason", err,
+		).Warn("rejected storage analytics log entry")
+		return nil
+	}
+
+	log.WithField(
+		"operationType", fields[logFieldOperationType],
+	).WithField(
+		"requestStatus", fields[logFieldRequestStatus],
+	).WithField(
+		"blobUrl", blobURL,
+	).Debug("read storage analytics log entry")
+
+	ctx, err := a.route.newContext(blobURL)
+	if err != nil {
+		return err
+	}
+	err = a.coordinator.run(fields[logFieldRequestID], func() error {
+		_, err := deliver(a.ctxCh, ctx)
+		return err
+	})
+	if err == errClaimed {
+		// The replica that claimed the event is responsible for it
+		return nil
+	}
+	return err
+}
+
+// matchesRequester returns a bool indicating whether the requester of a log
+// entry, identified by account name, IP address (without port) or, for
+// version 2.0 entries, user principal name, is among the configured
+// requesters.
+func (a *analyticsLogsSource) matchesRequester(fields []string) bool {
+	candidates := []string{
+		fields[logFieldRequesterAccount],
+		strings.Split(fields[logFieldRequesterIP], ":")[0],
+	}
+	if fields[logFieldVersion] == "2.0" {
+		candidates = append(candidates, fields[logFieldUserPrincipalName])
+	}
+	for _, candidate := range candidates {
+		if _, ok := a.requesters[candidate]; ok && candidate != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// logEntryBlobURL returns the URL of the blob that was the subject of a
+// request, stripped of its query string (which may include a SAS token).
+func logEntryBlobURL(requestURL string) (string, error) {
+	u, err := url.Parse(requestURL)
+	if err != nil {
+		return "", err
+	}
+	u.Scheme = "https"
+	u.RawQuery = ""
+	u.Host = strings.Split(u.Host, ":")[0]
+	return u.String(), nil
+}
+
+// parseLogEntry splits a log entry into its fields, removing the quotes that
+// surround fields that may contain semicolons.
+func parseLogEntry(entry string) []string {
+	fields := []string{}
+	var field strings.Builder
+	var quoted bool
+	for _, r := range entry {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ';' && !quoted:
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteRune(r)
+		}
+	}
+	return append(fields, field.String())
+}
+
+func newSet(list []string) map[string]struct{} {
+	set := map[string]struct{}{}
+	for _, item := range list {
+		set[item] = struct{}{}
+	}
+	return set
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// This file implements just enough of the Avro object container file format
+// to read the segment files written to the blob change feed. Records are
+// decoded into generic values: records and maps become
+// map[string]interface{}, arrays become []interface{}, enums become their
+// symbol and bytes or fixed become []byte.
+
+var avroMagic = []byte{'O', 'b', 'j', 1}
+
+const avroSyncSize = 16
+
+type avroSchema struct {
+	typ     string
+	fields  []avroField
+	items   *avroSchema
+	values  *avroSchema
+	symbols []string
+	size    int
+	union   []*avroSchema
+}
+
+type avroField struct {
+	name   string
+	schema *avroSchema
+}
+
+// readAvroFile reads all records from an Avro object container file.
+func readAvroFile(r io.Reader) ([]interface{}, error) {
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(avroMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, fmt.Errorf("error reading avro header: %s", err)
+	}
+	if !bytes.Equal(magic, avroMagic) {
+		return nil, errors.New("not an avro object container file")
+	}
+
+	metaSchema := &avroSchema{typ: "map", values: &avroSchema{typ: "bytes"}}
+	iMeta, err := decodeAvro(br, metaSchema)
+	if err != nil {
+		return nil, fmt.Errorf("error reading avro header metadata: %s", err)
+	}
+	meta := iMeta.(map[string]interface{})
+
+	schemaBytes, ok := meta["avro.schema"].([]byte)
+	if !ok {
+		return nil, errors.New("avro header does not include a schema")
+	}
+	schema, err := parseAvroSchema(schemaBytes, map[string]*avroSchema{}, "")
+	if err != nil {
+		return nil, fmt.Errorf("error parsing avro schema: %s", err)
+	}
+
+	codec := "null"
+	if codecBytes, ok := meta["avro.codec"].([]byte); ok {
+		codec = string(codecBytes)
+	}
+	if codec != "null" && codec != "deflate" {
+		return nil, fmt.Errorf(`unsupported avro codec "%s"`, codec)
+	}
+
+	sync := make([]byte, avroSyncSize)
+	if _, err := io.ReadFull(br, sync); err != nil {
+		return nil, fmt.Errorf("error reading avro sync marker: %s", err)
+	}
+
+	records := []interface{}{}
+	for {
+		count, err := readAvroLong(br)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading avro block: %s", err)
+		}
+		size, err := readAvroLong(br)
+		if err != nil {
+			return nil, fmt.Errorf("error reading avro block: %s", err)
+		}
+		block := make([]byte, size)
+		if _, err := io.ReadFull(br, block); err != nil {
+			return nil, fmt.Errorf("error reading avro block: %s", err)
+		}
+		if codec == "deflate" {
+			if block, err = ioutil.ReadAll(
+				flate.NewReader(bytes.NewReader(block)),
+			); err != nil {
+				return nil, fmt.Errorf("error inflating avro block: %s", err)
+			}
+		}
+		blockReader := bytes.NewReader(block)
+		for i := int64(0); i < count; i++ {
+			record, err := decodeAvro(blockReader, schema)
+			if err != nil {
+				return nil, fmt.Errorf("error decoding avro record: %s", err)
+			}
+			records = append(records, record)
+		}
+		blockSync := make([]byte, avroSyncSize)
+		if _, err := io.ReadFull(br, blockSync); err != nil {
+			return nil, fmt.Errorf("error reading avro sync marker: %s", err)
+		}
+		if !bytes.Equal(blockSync, sync) {
+			return nil, errors.New("avro sync marker mismatch")
+		}
+	}
+}
+
+// parseAvroSchema parses a JSON encoded avro schema. Named types are
+// registered in names so that they may be referenced later in the schema.
+func parseAvroSchema(
+	raw json.RawMessage,
+	names map[string]*avroSchema,
+	namespace string,
+) (*avroSchema, error) {
+	var name string
+	if err := json.Unmarshal(raw, &name); err == nil {
+		switch name {
+		case "null", "boolean", "int", "long", "float", "double", "bytes",
+			"string":
+			return &avroSchema{typ: name}, nil
+		}
+		if schema, ok := names[name]; ok {
+			return schema, nil
+		}
+		if schema, ok := names[namespace+"."+name]; ok {
+			return schema, nil
+		}
+		return nil, fmt.Errorf(`unknown avro type "%s"`, name)
+	}
+
+	var union []json.RawMessage
+	if err := json.Unmarshal(raw, &union); err == nil {
+		schema := &avroSchema{typ: "union"}
+		for _, branch := range union {
+			branchSchema, err := parseAvroSchema(branch, names, namespace)
+			if err != nil {
+				return nil, err
+			}
+			schema.union = append(schema.union, branchSchema)
+		}
+		return schema, nil
+	}
+
+	var obj struct {
+		Type      json.RawMessage `json:"type"`
+		Name      string          `json:"name"`
+		Namespace string          `json:"namespace"`
+		Fields    []struct {
+			Name string          `json:"name"`
+			Type json.RawMessage `json:"type"`
+		} `json:"fields"`
+		Items   json.RawMessage `json:"items"`
+		Values  json.RawMessage `json:"values"`
+		Symbols []string        `json:"symbols"`
+		Size    int             `json:"size"`
+	}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, fmt.Errorf("invalid avro schema: %s", err)
+	}
+	var typ string
+	if err := json.Unmarshal(obj.Type, &typ); err != nil {
+		// The type is itself a complex schema
+		return parseAvroSchema(obj.Type, names, namespace)
+	}
+	if obj.Namespace != "" {
+		namespace = obj.Namespace
+	}
+	schema := &avroSchema{typ: typ}
+	switch typ {
+	case "record", "error", "enum", "fixed":
+		schema.symbols = obj.Symbols
+		schema.size = obj.Size
+		names[obj.Name] = schema
+		if namespace != "" {
+			names[namespace+"."+obj.Name] = schema
+		}
+		if typ == "error" {
+			schema.typ = "record"
+		}
+		for _, field := range obj.Fields {
+			fieldSchema, err := parseAvroSchema(field.Type, names, namespace)
+			if err != nil {
+				return nil, err
+			}
+			schema.fields = append(
+				schema.fields,
+				avroField{name: field.Name, schema: fieldSchema},
+			)
+		}
+	case "array":
+		items, err := parseAvroSchema(obj.Items, names, namespace)
+		if err != nil {
+			return nil, err
+		}
+		schema.items = items
+	case "map":
+		values, err := parseAvroSchema(obj.Values, names, namespace)
+		if err != nil {
+			return nil, err
+		}
+		schema.values = values
+	default:
+		// A primitive type, possibly annotated with a logical type
+		return parseAvroSchema(obj.Type, names, namespace)
+	}
+	return schema, nil
+}
+
+type avroReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+func decodeAvro(r avroReader, schema *avroSchema) (interface{}, error) {
+	switch schema.typ {
+	case "null":
+		return nil, nil
+	case "boolean":
+		b, err := r.ReadByte()
+		return b != 0, err
+	case "int", "long":
+		return readAvroLong(r)
+	case "float":
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return math.Float32frombits(binary.LittleEndian.Uint32(buf)), nil
+	case "double":
+		buf := make([]byte, 8)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(buf)), nil
+	case "bytes":
+		return readAvroBytes(r)
+	case "string":
+		b, err := readAvroBytes(r)
+		return string(b), err
+	case "fixed":
+		buf := make([]byte, schema.size)
+		_, err := io.ReadFull(r, buf)
+		return buf, err
+	case "enum":
+		index, err := readAvroLong(r)
+		if err != nil {
+			return nil, err
+		}
+		if index < 0 || index >= int64(len(schema.symbols)) {
+			return nil, fmt.Errorf("avro enum index %d out of range", index)
+		}
+		return schema.symbols[index], nil
+	case "union":
+		index, err := readAvroLong(r)
+		if err != nil {
+			return nil, err
+		}
+		if index < 0 || index >= int64(len(schema.union)) {
+			return nil, fmt.Errorf("avro union index %d out of range", index)
+		}
+		return decodeAvro(r, schema.union[index])
+	case "record":
+		record := map[string]interface{}{}
+		for _, field := range schema.fields {
+			val, err := decodeAvro(r, field.schema)
+			if err != nil {
+				return nil, err
+			}
+			record[field.name] = val
+		}
+		return record, nil
+	case "array":
+		array := []interface{}{}
+		err := readAvroBlocks(r, func() error {
+			item, err := decodeAvro(r, schema.items)
+			array = append(array, item)
+			return err
+		})
+		return array, err
+	case "map":
+		m := map[string]interface{}{}
+		err := readAvroBlocks(r, func() error {
+			key, err := readAvroBytes(r)
+			if err != nil {
+				return err
+			}
+			val, err := decodeAvro(r, schema.values)
+			m[string(key)] = val
+			return err
+		})
+		return m, err
+	}
+	return nil, fmt.Errorf(`unsupported avro type "%s"`, schema.typ)
+}
+
+// readAvroBlocks reads the blocks that make up an encoded array or map,
+// invoking fn once per item.
+func readAvroBlocks(r avroReader, fn func() error) error {
+	for {
+		count, err := readAvroLong(r)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return nil
+		}
+		if count < 0 {
+			// A negative count is followed by the block's size in bytes
+			count = -count
+			if _, err := readAvroLong(r); err != nil {
+				return err
+			}
+		}
+		for i := int64(0); i < count; i++ {
+			if err := fn(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func readAvroLong(r io.ByteReader) (int64, error) {
+	u, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, err
+	}
+	return int64(u>>1) ^ -int64(u&1), nil
+}
+
+func readAvroBytes(r avroReader) ([]byte, error) {
+	size, err := readAvroLong(r)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("invalid avro length %d", size)
+	}
+	buf := make([]byte, size)
+	_, err = io.ReadFull(r, buf)
+	return buf, err
+}
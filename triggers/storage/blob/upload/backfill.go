@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/2018-03-28/azblob"
+	log "github.com/Sirupsen/logrus"
+	"github.com/faasaf/frameworks/trigger"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+const blobCreatedEventType = "Microsoft.Storage.BlobCreated"
+
+var backfillCommand = cli.Command{
+	Name: "backfill",
+	Usage: "deliver synthetic BlobCreated events for existing blobs to a " +
+		"local faasaf runtime",
+	Flags: append(
+		[]cli.Flag{
+			cli.StringFlag{
+				Name:  "container",
+				Usage: "the container to list",
+			},
+			cli.StringFlag{
+				Name:  "prefix",
+				Usage: "only deliver events for blobs whose names begin with prefix",
+			},
+			cli.Float64Flag{
+				Name: "rate",
+				Usage: "the maximum number of events to deliver per second; 0 is " +
+					"unlimited",
+			},
+			cli.IntFlag{
+				Name:  "concurrency",
+				Value: 1,
+				Usage: "the maximum number of events to deliver concurrently",
+			},
+			cli.StringFlag{
+				Name: "checkpoint-file",
+				Usage: "record progress in the given file and, if it exists, " +
+					"resume from it",
+			},
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "print the events that would be delivered without delivering them",
+			},
+		},
+		commonFlags...,
+	),
+	Action: backfill,
+}
+
+// backfillCheckpoint records the listing marker of the segment of blobs being
+// processed, or that the backfill is done. Markers are opaque, so the marker
+// echoed back with each segment is recorded rather than the next marker.
+type backfillCheckpoint struct {
+	Marker string `json:"marker"`
+	Done   bool   `json:"done"`
+}
+
+// backfill lists a container and, for each blob found, builds the event that
+// Event Grid would have delivered when the blob was created and hands it to
+// the runtime using the same filter and context key mapping as the trigger
+// itself.
+func backfill(c *cli.Context) error {
+	container := c.String("container")
+	if container == "" {
+		return errors.New("the container (--container) was not specified")
+	}
+	concurrency := c.Int("concurrency")
+	if concurrency < 1 {
+		return errors.New("the concurrency must be at least 1")
+	}
+	rate := c.Float64("rate")
+	if rate < 0 {
+		return errors.New("the rate must not be negative")
+	}
+	dryRun := c.Bool("dry-run")
+
+	cfg, err := setUpCommand(c)
+	if err != nil {
+		return err
+	}
+	serviceURL, err := newServiceURL(cfg)
+	if err != nil {
+		return err
+	}
+	accountName := cfg.GetSetting("account", "")
+	containerURL := serviceURL.NewContainerURL(container)
+	rt := newRoute(cfg, "backfill", "")
+	allowlist := newAllowlist(cfg)
+
+	var checkpoint checkpointer
+	cp := backfillCheckpoint{}
+	if path := c.String("checkpoint-file"); path != "" {
+		checkpoint = &fileCheckpointer{path: path}
+		if _, err := checkpoint.load(&cp); err != nil {
+			return fmt.Errorf("error loading checkpoint: %s", err)
+		}
+	}
+
+	if cp.Done {
+		fmt.Println("the backfill recorded in the checkpoint file is complete")
+		return nil
+	}
+
+	ctxCh := make(chan trigger.ContextWrapper)
+	go serveRuntime(ctxCh, c.Int("runtime-port"))
+
+	var throttle <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+
+	marker, err := newMarker(cp.Marker)
+	if err != nil {
+		return fmt.Errorf("error loading checkpoint: %s", err)
+	}
+
+	var sent, skipped, failed int
+	var countsMutex sync.Mutex
+	for marker.NotDone() {
+		res, err := containerURL.ListBlobsFlatSegment(
+			context.Background(),
+			marker,
+			azblob.ListBlobsSegmentOptions{Prefix: c.String("prefix")},
+		)
+		if err != nil {
+			return err
+		}
+		if checkpoint != nil && !dryRun {
+			cp.Marker = res.Marker
+			if err := checkpoint.save(cp); err != nil {
+				return fmt.Errorf("error saving checkpoint: %s", err)
+			}
+		}
+
+		evtCh := make(chan event)
+		wg := sync.WaitGroup{}
+		for i := 0; i < concurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for evt := range evtCh {
+					result, err := backfillEvent(ctxCh, rt, allowlist, evt, dryRun)
+					countsMutex.Lock()
+					switch {
+					case err != nil:
+						failed++
+						fmt.Printf("FAIL %s %s\n", evt.Data.URL, err)
+					case result:
+						sent++
+					default:
+						skipped++
+					}
+					countsMutex.Unlock()
+				}
+			}()
+		}
+		for _, item := range res.Segment.BlobItems {
+			if throttle != nil {
+				<-throttle
+			}
+			evtCh <- newBlobCreatedEvent(accountName, container, item)
+		}
+		close(evtCh)
+		wg.Wait()
+
+		if failed > 0 {
+			// The checkpoint still refers to this segment, so it is retried
+			// when the backfill is resumed
+			break
+		}
+		marker = res.NextMarker
+	}
+
+	if checkpoint != nil && !dryRun && failed == 0 {
+		cp.Done = true
+		if err := checkpoint.save(cp); err != nil {
+			return fmt.Errorf("error saving checkpoint: %s", err)
+		}
+	}
+
+	fmt.Printf("%d sent, %d skipped, %d failed\n", sent, skipped, failed)
+	if failed > 0 {
+		return cli.NewExitError("", 1)
+	}
+	return nil
+}
+
+// backfillEvent delivers a single event, or prints it in a dry run. It
+// returns a bool indicating whether the event passed the filter.
+func backfillEvent(
+	ctxCh chan trigger.ContextWrapper,
+	rt *route,
+	allowlist *allowlist,
+	evt event,
+	dryRun bool,
+) (bool, error) {
+	if !rt.accepts(evt) {
+		log.WithField(
+			"blobUrl", evt.Data.URL,
+		).Debug("event did not pass filter; skipping")
+		return false, nil
+	}
+	if matches := blobURLRegex.FindStringSubmatch(evt.Data.URL); matches != nil {
+		if err := allowlist.checkAccount(matches[1]); err != nil {
+			return false, err
+		}
+	}
+	ctx, err := rt.newContext(evt.Data.URL)
+	if err != nil {
+		return false, err
+	}
+	if dryRun {
+		evtBytes, err := json.Marshal(evt)
+		if err != nil {
+			return false, err
+		}
+		ctxBytes, err := json.Marshal(ctx)
+		if err != nil {
+			return false, err
+		}
+		fmt.Printf("DRY-RUN event=%s context=%s\n", evtBytes, ctxBytes)
+		return true, nil
+	}
+	if _, err := deliver(ctxCh, ctx); err != nil {
+		return false, err
+	}
+	fmt.Printf("SENT %s\n", evt.Data.URL)
+	return true, nil
+}
+
+// newBlobCreatedEvent returns the event that Event Grid would have delivered
+// when the given blob was created. The blob URL is always the blob's public
+// URL, regardless of the blob endpoint used to list it.
+func newBlobCreatedEvent(
+	accountName string,
+	container string,
+	item azblob.BlobItem,
+) event {
+	evt := event{
+		ID: fmt.Sprintf(
+			"%s/%s@%s",
+			container,
+			item.Name,
+			item.Properties.Etag,
+		),
+		Subject: fmt.Sprintf(
+			"/blobServices/default/containers/%s/blobs/%s",
+			container,
+			item.Name,
+		),
+		EventType: blobCreatedEventType,
+		EventTime: item.Properties.LastModified,
+		Data: eventData{
+			API:      "PutBlob",
+			ETag:     string(item.Properties.Etag),
+			BlobType: string(item.Properties.BlobType),
+			URL: fmt.Sprintf(
+				"https://%s.blob.core.windows.net/%s/%s",
+				accountName,
+				container,
+				item.Name,
+			),
+		},
+		MetadataVersion: "1",
+	}
+	if item.Properties.ContentType != nil {
+		evt.Data.ContentType = *item.Properties.ContentType
+	}
+	if item.Properties.ContentLength != nil {
+		evt.Data.ContentLength = *item.Properties.ContentLength
+	}
+	return evt
+}
+
+// newMarker returns a listing marker with the given value. An empty value
+// yields a marker for the first segment.
+func newMarker(val string) (azblob.Marker, error) {
+	marker := azblob.Marker{}
+	if val == "" {
+		return marker, nil
+	}
+	// Markers may only be set by unmarshaling them from a listing response
+	valBytes := &bytes.Buffer{}
+	if err := xml.EscapeText(valBytes, []byte(val)); err != nil {
+		return marker, err
+	}
+	err := xml.Unmarshal(
+		[]byte("<NextMarker>"+valBytes.String()+"</NextMarker>"),
+		&marker,
+	)
+	return marker, err
+}
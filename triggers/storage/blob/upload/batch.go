@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/faasaf/frameworks/common"
+	"github.com/faasaf/frameworks/trigger"
+)
+
+// batcher buffers events and delivers them to the runtime as a single context
+// once a number of events have accumulated or a period of time has passed
+// since the first of them was received. The context holds a list of the
+// blobs, each described by its URL, account, container and path, under a
+// configurable key.
+//
+// If the runtime fails to process a batch, every event in the batch fails or,
+// optionally, the batch is split and each event is retried individually
+// using the same context it would have had without batching.
+type batcher struct {
+	size       int
+	timeout    time.Duration
+	contextKey string
+	split      bool
+	ctxCh      chan trigger.ContextWrapper
+	mutex      sync.Mutex
+	pending    []*batchItem
+	generation int
+}
+
+type batchItem struct {
+	ctx    common.Context
+	entry  map[string]interface{}
+	result chan error
+}
+
+// newBatcher returns a batcher if batching is enabled (batchSize > 1) and nil
+// otherwise.
+func newBatcher(cfg config) (*batcher, error) {
+	sizeStr := cfg.GetSetting("batchSize", "0")
+	size, err := strconv.Atoi(sizeStr)
+	if err != nil {
+		return nil, fmt.Errorf(
+			`the specified batch size "%s" could not be parsed as an integer`,
+			sizeStr,
+		)
+	}
+	if size <= 1 {
+		return nil, nil
+	}
+
+	timeoutStr := cfg.GetSetting("batchTimeout", "10s")
+	timeout, err := time.ParseDuration(timeoutStr)
+	if err != nil {
+		return nil, fmt.Errorf(
+			`the specified batch timeout "%s" could not be parsed as a duration`,
+			timeoutStr,
+		)
+	}
+
+	contextKey := cfg.GetSetting("batchContextKey", "")
+	if contextKey == "" {
+		return nil, errors.New(
+			"the batch context key (batchContextKey) must be specified when " +
+				"batching",
+		)
+	}
+
+	var split bool
+	switch errorMode := cfg.GetSetting("batchErrorMode", "fail"); errorMode {
+	case "fail":
+	case "split":
+		split = true
+	default:
+		return nil, fmt.Errorf(
+			`the specified batch error mode "%s" is not one of fail or split`,
+			errorMode,
+		)
+	}
+
+	log.WithField(
+		"batchSize", size,
+	).WithField(
+		"batchTimeout", timeout,
+	).WithField(
+		"batchContextKey", contextKey,
+	).WithField(
+		"split", split,
+	).Info("batching configured")
+
+	return &batcher{
+		size:       size,
+		timeout:    timeout,
+		contextKey: contextKey,
+		split:      split,
+	}, nil
+}
+
+// deliver adds the blob at the given URL to the current batch and blocks until
+// the batch, or, having been split, the event's own context, has been
+// processed.
+func (b *batcher) deliver(ctx common.Context, blobURL string) error {
+	matches := blobURLRegex.FindStringSubmatch(blobURL)
+	if len(matches) == 0 {
+		return fmt.Errorf("blob URL is not a valid Azure Storage URL: %s", blobURL)
+	}
+	item := &batchItem{
+		ctx: ctx,
+		entry: map[string]interface{}{
+			"blobUrl":   blobURL,
+			"account":   matches[1],
+			"container": matches[2],
+			"blobPath":  matches[3],
+		},
+		result: make(chan error, 1),
+	}
+
+	b.mutex.Lock()
+	b.pending = append(b.pending, item)
+	if len(b.pending) == 1 {
+		generation := b.generation
+		time.AfterFunc(b.timeout, func() {
+			b.mutex.Lock()
+			if generation != b.generation {
+				// The batch was already flushed because it was full
+				b.mutex.Unlock()
+				return
+			}
+			batch := b.take()
+			b.mutex.Unlock()
+			b.flush(batch)
+		})
+	}
+	if len(b.pending) >= b.size {
+		batch := b.take()
+		b.mutex.Unlock()
+		go b.flush(batch)
+	} else {
+		b.mutex.Unlock()
+	}
+
+	return <-item.result
+}
+
+// take removes and returns the pending batch. The caller must hold the mutex.
+func (b *batcher) take() []*batchItem {
+	batch := b.pending
+	b.pending = nil
+	b.generation++
+	return batch
+}
+
+func (b *batcher) flush(batch []*batchItem) {
+	entries := make([]interface{}, len(batch))
+	for i, item := range batch {
+		entries[i] = item.entry
+	}
+	ctx := common.NewContext()
+	log.WithField(
+		"key", b.contextKey,
+	).WithField(
+		"events", len(entries),
+	).Debug("delivering batch")
+	ctx.Set(b.contextKey, entries)
+
+	_, err := deliver(b.ctxCh, ctx)
+	if err == nil || !b.split {
+		for _, item := range batch {
+			item.result <- err
+		}
+		return
+	}
+
+	log.WithField(
+		"error", err,
+	).WithField(
+		"events", len(entries),
+	).Warn("error delivering batch; retrying events individually")
+	for _, item := range batch {
+		go func(item *batchItem) {
+			_, err := deliver(b.ctxCh, item.ctx)
+			item.result <- err
+		}(item)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/2018-03-28/azblob"
+	log "github.com/Sirupsen/logrus"
+	"github.com/faasaf/frameworks/trigger"
+)
+
+// The change feed is laid out within the $blobchangefeed container as
+// follows:
+//
+//   meta/segments.json
+//     Records the time up to which the change feed may be consumed
+//     ("lastConsumable").
+//   idx/segments/<yyyy>/<mm>/<dd>/<hhmm>/meta.json
+//     Describes an (hourly) segment, including the paths of the shards
+//     ("chunkFilePaths") that make up the segment.
+//   log/<shard>/<yyyy>/<mm>/<dd>/<hhmm>/<nnnnn>.avro
+//     Avro encoded change records. Records are ordered within a shard.
+
+const (
+	changeFeedContainer       = "$blobchangefeed"
+	changeFeedMetaPath        = "meta/segments.json"
+	changeFeedSegmentsPrefix  = "idx/segments/"
+	changeFeedSegmentTimePath = "2006/01/02/1504"
+	changeFeedEventTypePrefix = "Microsoft.Storage."
+)
+
+// changeFeedCursor identifies the next change record to be processed. Offset
+// is the number of records within the chunk that have already been processed.
+type changeFeedCursor struct {
+	Segment string `json:"segment"`
+	Shard   int    `json:"shard"`
+	Chunk   string `json:"chunk"`
+	Offset  int    `json:"offset"`
+}
+
+type changeFeedSource struct {
+	containerURL azblob.ContainerURL
+	route        *route
+	allowlist    *allowlist
+	coordinator  *coordinator
+	checkpoint   checkpointer
+	pollInterval time.Duration
+	cursor       changeFeedCursor
+	ctxCh        chan trigger.ContextWrapper
+}
+
+func newChangeFeedSource(cfg config) (*changeFeedSource, error) {
+	serviceURL, err := newServiceURL(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoint, err := newCheckpointer(cfg, serviceURL)
+	if err != nil {
+		return nil, err
+	}
+
+	coordinator, err := newCoordinator(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	pollIntervalStr := cfg.GetSetting("pollInterval", "1m")
+	pollInterval, err := time.ParseDuration(pollIntervalStr)
+	if err != nil {
+		return nil, fmt.Errorf(
+			`the specified poll interval "%s" could not be parsed as a duration`,
+			pollIntervalStr,
+		)
+	}
+
+	return &changeFeedSource{
+		containerURL: serviceURL.NewContainerURL(changeFeedContainer),
+		route:        newRoute(cfg, "changeFeed", ""),
+		allowlist:    newAllowlist(cfg),
+		coordinator:  coordinator,
+		checkpoint:   checkpoint,
+		pollInterval: pollInterval,
+	}, nil
+}
+
+func (c *changeFeedSource) Run(
+	ctxCh chan trigger.ContextWrapper,
+	errCh chan error,
+) error {
+	c.ctxCh = ctxCh
+	if _, err := c.checkpoint.load(&c.cursor); err != nil {
+		return fmt.Errorf("error loading change feed checkpoint: %s", err)
+	}
+	log.WithField(
+		"segment", c.cursor.Segment,
+	).WithField(
+		"shard", c.cursor.Shard,
+	).WithField(
+		"chunk", c.cursor.Chunk,
+	).WithField(
+		"offset", c.cursor.Offset,
+	).Info("reading blob change feed")
+	for {
+		if err := c.poll(context.Background()); err != nil {
+			errCh <- fmt.Errorf("error reading blob change feed: %s", err)
+		}
+		time.Sleep(c.pollInterval)
+	}
+}
+
+// poll processes all change records written to consumable segments since the
+// cursor.
+func (c *changeFeedSource) poll(ctx context.Context) error {
+	metaBytes, err := downloadBlob(
+		ctx,
+		c.containerURL.NewBlobURL(changeFeedMetaPath),
+	)
+	if isStorageError(err, azblob.ServiceCodeContainerNotFound) ||
+		isStorageError(err, azblob.ServiceCodeBlobNotFound) {
+		log.Debug("the blob change feed is empty or not enabled")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	meta := struct {
+		LastConsumable time.Time `json:"lastConsumable"`
+	}{}
+	if err := json.Unmarshal(metaBytes, &meta); err != nil {
+		return fmt.Errorf("error parsing %s: %s", changeFeedMetaPath, err)
+	}
+
+	segments, err := listBlobs(ctx, c.containerURL, changeFeedSegmentsPrefix)
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if !strings.HasSuffix(segment, "/meta.json") ||
+			segment < c.cursor.Segment {
+			continue
+		}
+		segmentTime, err := time.Parse(
+			changeFeedSegmentTimePath,
+			strings.TrimSuffix(
+				strings.TrimPrefix(segment, changeFeedSegmentsPrefix),
+				"/meta.json",
+			),
+		)
+		if err != nil {
+			return fmt.Errorf(`error parsing segment path "%s": %s`, segment, err)
+		}
+		if !segmentTime.Before(meta.LastConsumable) {
+			break
+		}
+		if segment != c.cursor.Segment {
+			c.cursor = changeFeedCursor{Segment: segment}
+		}
+		if err := c.processSegment(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *changeFeedSource) processSegment(ctx context.Context) error {
+	segmentBytes, err := downloadBlob(
+		ctx,
+		c.containerURL.NewBlobURL(c.cursor.Segment),
+	)
+	if err != nil {
+		return err
+	}
+	segment := struct {
+		ChunkFilePaths []string `json:"chunkFilePaths"`
+	}{}
+	if err := json.Unmarshal(segmentBytes, &segment); err != nil {
+		return fmt.Errorf("error parsing %s: %s", c.cursor.Segment, err)
+	}
+	if c.cursor.Shard >= len(segment.ChunkFilePaths) {
+		// The segment has already been processed in its entirety
+		return nil
+	}
+
+	log.WithField(
+		"segment", c.cursor.Segment,
+	).Debug("processing change feed segment")
+
+	for shard := c.cursor.Shard; shard < len(segment.ChunkFilePaths); shard++ {
+		if shard != c.cursor.Shard {
+			c.cursor.Shard = shard
+			c.cursor.Chunk = ""
+			c.cursor.Offset = 0
+		}
+		chunks, err := listBlobs(
+			ctx,
+			c.containerURL,
+			strings.TrimPrefix(
+				segment.ChunkFilePaths[shard],
+				changeFeedContainer+"/",
+			),
+		)
+		if err != nil {
+			return err
+		}
+		for _, chunk := range chunks {
+			if chunk < c.cursor.Chunk {
+				continue
+			}
+			if chunk != c.cursor.Chunk {
+				c.cursor.Chunk = chunk
+				c.cursor.Offset = 0
+			}
+			if err := c.processChunk(ctx); err != nil {
+				return err
+			}
+		}
+	}
+
+	c.cursor.Shard = len(segment.ChunkFilePaths)
+	c.cursor.Chunk = ""
+	c.cursor.Offset = 0
+	return c.checkpoint.save(c.cursor)
+}
+
+func (c *changeFeedSource) processChunk(ctx context.Context) error {
+	chunkBytes, err := downloadBlob(
+		ctx,
+		c.containerURL.NewBlobURL(c.cursor.Chunk),
+	)
+	if err != nil {
+		return err
+	}
+	records, err := readAvroFile(bytes.NewReader(chunkBytes))
+	if err != nil {
+		return fmt.Errorf("error reading %s: %s", c.cursor.Chunk, err)
+	}
+	for c.cursor.Offset < len(records) {
+		if err := c.processRecord(records[c.cursor.Offset]); err != nil {
+			return fmt.Errorf(
+				"error processing record %d of %s: %s",
+				c.cursor.Offset,
+				c.cursor.Chunk,
+				err,
+			)
+		}
+		c.cursor.Offset++
+		if err := c.checkpoint.save(c.cursor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// processRecord converts a change record into the event that Event Grid would
+// have delivered and hands it to the runtime.
+func (c *changeFeedSource) processRecord(record interface{}) error {
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	evt := event{}
+	if err := json.Unmarshal(recordBytes, &evt); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(evt.EventType, changeFeedEventTypePrefix) {
+		evt.EventType = changeFeedEventTypePrefix + evt.EventType
+	}
+
+	log.WithField(
+		"eventType", evt.EventType,
+	).WithField(
+		"subject", evt.Subject,
+	).WithField(
+		"blobUrl", evt.Data.URL,
+	).Debug("read change record")
+
+	if !c.route.accepts(evt) {
+		log.WithField(
+			"blobUrl", evt.Data.URL,
+		).Debug("change record did not pass filter; ignoring")
+		return nil
+	}
+
+	if matches := blobURLRegex.FindStringSubmatch(evt.Data.URL); matches != nil {
+		if err := c.allowlist.check(matches[1], evt.Topic); err != nil {
+			log.WithField(
+				"topic", evt.Topic,
+			).WithField(
+				"blobUrl", evt.Data.URL,
+			).WithField(
+				"reason", err,
+			).Warn("rejected change record")
+			return nil
+		}
+	}
+
+	ctx, err := c.route.newContext(evt.Data.URL)
+	if err != nil {
+		// Retrying would not help; skip the record rather than stall the feed
+		log.WithField(
+			"error", err,
+		).Warn("skipped change record")
+		return nil
+	}
+	err = c.coordinator.run(evt.key(), func() error {
+		_, err := deliver(c.ctxCh, ctx)
+		return err
+	})
+	if err == errClaimed {
+		// The replica that claimed the event is responsible for it
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Azure/azure-storage-blob-go/2018-03-28/azblob"
+)
+
+// checkpointer durably records the progress of a polling trigger source so
+// that it can resume where it left off after a restart.
+type checkpointer interface {
+	// load unmarshals the most recently saved checkpoint into v and returns a
+	// bool indicating whether a checkpoint was found.
+	load(v interface{}) (bool, error)
+	// save replaces the saved checkpoint with v.
+	save(v interface{}) error
+}
+
+// newCheckpointer returns a checkpointer that stores checkpoints in a local
+// file (checkpointFile) or, failing that, in a blob (checkpointBlob, given as
+// "<container>/<path>") within the configured storage account.
+func newCheckpointer(
+	cfg config,
+	serviceURL azblob.ServiceURL,
+) (checkpointer, error) {
+	if path := cfg.GetSetting("checkpointFile", ""); path != "" {
+		return &fileCheckpointer{path: path}, nil
+	}
+	if blobPath := cfg.GetSetting("checkpointBlob", ""); blobPath != "" {
+		tokens := strings.SplitN(blobPath, "/", 2)
+		if len(tokens) != 2 || tokens[0] == "" || tokens[1] == "" {
+			return nil, errors.New(
+				"the checkpoint blob (checkpointBlob) must be of the form " +
+					"<container>/<path>",
+			)
+		}
+		return &blobCheckpointer{
+			blobURL: serviceURL.NewContainerURL(tokens[0]).
+				NewBlockBlobURL(tokens[1]),
+		}, nil
+	}
+	return nil, errors.New(
+		"the checkpoint file (checkpointFile) OR the checkpoint blob " +
+			"(checkpointBlob) must be specified",
+	)
+}
+
+type fileCheckpointer struct {
+	path string
+}
+
+func (f *fileCheckpointer) load(v interface{}) (bool, error) {
+	checkpointBytes, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(checkpointBytes, v)
+}
+
+// save writes the checkpoint to a temporary file and renames it into place so
+// that a crash never leaves a partially written checkpoint behind.
+func (f *fileCheckpointer) save(v interface{}) error {
+	checkpointBytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(f.path), ".checkpoint")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(checkpointBytes); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), f.path)
+}
+
+type blobCheckpointer struct {
+	blobURL azblob.BlockBlobURL
+}
+
+func (b *blobCheckpointer) load(v interface{}) (bool, error) {
+	checkpointBytes, err := downloadBlob(
+		context.Background(),
+		b.blobURL.BlobURL,
+	)
+	if isStorageError(err, azblob.ServiceCodeBlobNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(checkpointBytes, v)
+}
+
+func (b *blobCheckpointer) save(v interface{}) error {
+	checkpointBytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = b.blobURL.Upload(
+		context.Background(),
+		bytes.NewReader(checkpointBytes),
+		azblob.BlobHTTPHeaders{ContentType: "application/json"},
+		azblob.Metadata{},
+		azblob.BlobAccessConditions{},
+	)
+	return err
+}
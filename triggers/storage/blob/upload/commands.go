@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+// commands are auxiliary commands supported by the trigger binary in addition
+// to running the trigger itself.
+var commands = []cli.Command{
+	replayCommand,
+	backfillCommand,
+}
+
+// commonFlags are flags shared by all auxiliary commands. They mirror the
+// flags of the trigger itself.
+var commonFlags = []cli.Flag{
+	cli.IntFlag{
+		Name:  "runtime-port, r",
+		Value: 8080,
+		Usage: "port number that the faasaf runtime is listening on",
+	},
+	cli.StringSliceFlag{
+		Name: "set, s",
+		Usage: "configure the command using key=value pairs, as for the " +
+			"trigger itself; this flag may be applied multiple times",
+	},
+	cli.StringFlag{
+		Name:  "log-level, ll",
+		Value: "info",
+	},
+}
+
+// runCommand runs the auxiliary command named by the first argument, if any,
+// and returns a bool indicating whether it did.
+func runCommand(args []string) bool {
+	if len(args) < 2 {
+		return false
+	}
+	for _, cmd := range commands {
+		if cmd.Name != args[1] {
+			continue
+		}
+		app := cli.NewApp()
+		app.Name = name
+		app.Version = version
+		app.Usage = ""
+		app.Commands = commands
+		if err := app.Run(args); err != nil {
+			log.Fatal(err)
+		}
+		return true
+	}
+	return false
+}
+
+// setUpCommand applies the common flags and returns the command's settings.
+func setUpCommand(c *cli.Context) (settings, error) {
+	logLevel, err := log.ParseLevel(c.String("log-level"))
+	if err != nil {
+		return nil, err
+	}
+	log.SetLevel(logLevel)
+	// Command output is written to stdout; keep logs separate
+	log.SetOutput(os.Stderr)
+	return newSettings(c.StringSlice("set"))
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// config is satisfied by trigger.Config. It permits commands other than the
+// trigger itself to be configured using the same settings.
+type config interface {
+	GetSetting(key, dflt string) string
+}
+
+// settings is a config built from key=value pairs.
+type settings map[string]string
+
+func newSettings(pairs []string) (settings, error) {
+	s := settings{}
+	for _, pair := range pairs {
+		tokens := strings.SplitN(pair, "=", 2)
+		if len(tokens) != 2 {
+			return s, fmt.Errorf("error parsing setting: %s", pair)
+		}
+		s[tokens[0]] = tokens[1]
+	}
+	return s, nil
+}
+
+func (s settings) GetSetting(key, dflt string) string {
+	val, ok := s[key]
+	if !ok {
+		return dflt
+	}
+	return val
+}
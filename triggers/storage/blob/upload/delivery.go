@@ -0,0 +1,22 @@
+package main
+
+import (
+	"github.com/faasaf/frameworks/common"
+	"github.com/faasaf/frameworks/trigger"
+)
+
+// deliver hands a context to the trigger framework for further processing by
+// the faasaf runtime and blocks until the runtime has responded.
+func deliver(
+	ctxCh chan trigger.ContextWrapper,
+	ctx common.Context,
+) (common.Context, error) {
+	ctxWrapper := trigger.NewContextWrapper(ctx)
+	ctxCh <- ctxWrapper
+	select {
+	case res := <-ctxWrapper.ResC():
+		return res, nil
+	case err := <-ctxWrapper.ErrC():
+		return nil, err
+	}
+}
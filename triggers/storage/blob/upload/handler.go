@@ -5,10 +5,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sync/atomic"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/faasaf/frameworks/common"
-	"github.com/faasaf/frameworks/trigger"
 )
 
 // For reference:
@@ -34,95 +34,125 @@ import (
 // }
 
 type event struct {
-	Data eventData `json:"data"`
+	ID              string    `json:"id"`
+	Topic           string    `json:"topic"`
+	Subject         string    `json:"subject"`
+	EventType       string    `json:"eventType"`
+	EventTime       time.Time `json:"eventTime"`
+	Data            eventData `json:"data"`
+	DataVersion     string    `json:"dataVersion"`
+	MetadataVersion string    `json:"metadataVersion"`
 }
 
 type eventData struct {
-	URL string `json:"url"`
+	API           string `json:"api,omitempty"`
+	ETag          string `json:"eTag,omitempty"`
+	ContentType   string `json:"contentType,omitempty"`
+	ContentLength int64  `json:"contentLength,omitempty"`
+	BlobType      string `json:"blobType,omitempty"`
+	URL           string `json:"url"`
+	Sequencer     string `json:"sequencer,omitempty"`
 }
 
-func (s *server) handleEvent(w http.ResponseWriter, r *http.Request) {
-	evt := event{}
-
-	defer r.Body.Close()
-	bodyBytes, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		s.errCh <- err
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	err = json.Unmarshal(bodyBytes, &evt)
-	if err != nil {
-		s.errCh <- err
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	log.WithField(
-		"blobUrl", evt.Data.URL,
-	).Debug("received event")
-
-	matches := blobURLRegex.FindStringSubmatch(evt.Data.URL)
-	if len(matches) == 0 {
-		s.errCh <- fmt.Errorf(
-			"blob URL is not a valid Azure Storage URL: %s",
-			evt.Data.URL,
-		)
-		w.WriteHeader(http.StatusBadRequest)
-		return
+// key returns a value that identifies the event across redeliveries.
+func (e event) key() string {
+	if e.ID != "" {
+		return e.ID
 	}
+	return e.Data.URL
+}
 
-	ctx := common.NewContext()
+func (s *server) handleEvent(rt *route) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := rt.authorize(r); err != nil {
+			s.errCh <- fmt.Errorf("route %s: %s", rt.name, err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		evt := event{}
+
+		defer r.Body.Close()
+		bodyBytes, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			s.errCh <- err
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		err = json.Unmarshal(bodyBytes, &evt)
+		if err != nil {
+			s.errCh <- err
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 
-	if s.blobURLContextKey != "" {
 		log.WithField(
-			"key", s.blobURLContextKey,
+			"route", rt.name,
 		).WithField(
-			"value", evt.Data.URL,
-		).Debug("updating context")
-		ctx.Set(s.blobURLContextKey, evt.Data.URL)
-	}
-
-	if s.accountContextKey != "" {
-		log.WithField(
-			"key", s.accountContextKey,
+			"eventType", evt.EventType,
 		).WithField(
-			"value", matches[1],
-		).Debug("updating context")
-		ctx.Set(s.accountContextKey, matches[1])
-	}
-
-	if s.containerContextKey != "" {
-		log.WithField(
-			"key", s.containerContextKey,
-		).WithField(
-			"value", matches[2],
-		).Debug("updating context")
-		ctx.Set(s.containerContextKey, matches[2])
-	}
-
-	if s.blobPathContextKey != "" {
-		log.WithField(
-			"key", s.blobPathContextKey,
+			"subject", evt.Subject,
 		).WithField(
-			"value", matches[3],
-		).Debug("updating context")
-		ctx.Set(s.blobPathContextKey, matches[3])
-	}
-
-	ctxWrapper := trigger.NewContextWrapper(ctx)
-
-	s.ctxCh <- ctxWrapper
-
-	select {
-	case <-ctxWrapper.ResC():
+			"blobUrl", evt.Data.URL,
+		).Debug("received event")
+
+		if !rt.accepts(evt) {
+			log.WithField(
+				"route", rt.name,
+			).WithField(
+				"blobUrl", evt.Data.URL,
+			).Debug("event did not pass route filter; ignoring")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if matches := blobURLRegex.FindStringSubmatch(evt.Data.URL); matches != nil {
+			if err := s.allowlist.check(matches[1], evt.Topic); err != nil {
+				log.WithField(
+					"route", rt.name,
+				).WithField(
+					"topic", evt.Topic,
+				).WithField(
+					"blobUrl", evt.Data.URL,
+				).WithField(
+					"reason", err,
+				).Warn("rejected event")
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+
+		ctx, err := rt.newContext(evt.Data.URL)
+		if err != nil {
+			s.errCh <- err
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		atomic.AddInt64(&s.inFlight, 1)
+		err = s.coordinator.run(evt.key(), func() error {
+			if s.batcher != nil {
+				return s.batcher.deliver(ctx, evt.Data.URL)
+			}
+			_, err := deliver(s.ctxCh, ctx)
+			return err
+		})
+		atomic.AddInt64(&s.inFlight, -1)
+		if err == errClaimed {
+			// Event Grid will redeliver the event; by then, the replica that
+			// claimed it will have processed it or given up its claim
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		if err != nil {
+			s.errCh <- fmt.Errorf(
+				"error handling event: %s",
+				err,
+			)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
-	case err := <-ctxWrapper.ErrC():
-		s.errCh <- fmt.Errorf(
-			"error handling event: %s",
-			err,
-		)
-		w.WriteHeader(http.StatusInternalServerError)
 	}
 }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/2018-03-28/azblob"
+	log "github.com/Sirupsen/logrus"
+)
+
+const processedMetadataKey = "processed"
+
+// errClaimed indicates that an event was not processed because another
+// replica has claimed it.
+var errClaimed = errors.New("the event was claimed by another replica")
+
+// coordinator ensures that, among several replicas of the trigger, exactly
+// one processes each event. Each event is represented by a marker blob in the
+// coordination container. A replica claims an event by acquiring a lease on
+// its marker, renews the lease while the runtime processes the event and,
+// upon success, records on the marker that the event was processed before
+// releasing the lease. Markers are never deleted by the trigger; a lifecycle
+// management policy on the coordination container should be used to expire
+// them.
+type coordinator struct {
+	containerURL  azblob.ContainerURL
+	leaseDuration time.Duration
+}
+
+// newCoordinator returns a coordinator if coordination is enabled
+// (coordinationContainer is specified) and nil otherwise.
+func newCoordinator(cfg config) (*coordinator, error) {
+	container := cfg.GetSetting("coordinationContainer", "")
+	if container == "" {
+		return nil, nil
+	}
+
+	leaseDurationStr := cfg.GetSetting("leaseDuration", "30s")
+	leaseDuration, err := time.ParseDuration(leaseDurationStr)
+	if err != nil {
+		return nil, fmt.Errorf(
+			`the specified lease duration "%s" could not be parsed as a duration`,
+			leaseDurationStr,
+		)
+	}
+	if leaseDuration < 15*time.Second || leaseDuration > 60*time.Second {
+		return nil, errors.New(
+			"the lease duration (leaseDuration) must be between 15s and 60s",
+		)
+	}
+
+	serviceURL, err := newServiceURL(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	log.WithField(
+		"coordinationContainer", container,
+	).WithField(
+		"leaseDuration", leaseDuration,
+	).Info("coordination with other replicas configured")
+
+	return &coordinator{
+		containerURL:  serviceURL.NewContainerURL(container),
+		leaseDuration: leaseDuration,
+	}, nil
+}
+
+// run invokes fn to process the event identified by id unless the event was
+// already processed, in which case it returns nil, or is claimed by another
+// replica, in which case it returns errClaimed. A nil coordinator always
+// invokes fn.
+func (c *coordinator) run(id string, fn func() error) error {
+	if c == nil {
+		return fn()
+	}
+	ctx := context.Background()
+	sum := sha256.Sum256([]byte(id))
+	markerURL := c.containerURL.NewBlockBlobURL(hex.EncodeToString(sum[:]))
+
+	if _, err := markerURL.Upload(
+		ctx,
+		bytes.NewReader(nil),
+		azblob.BlobHTTPHeaders{},
+		azblob.Metadata{},
+		azblob.BlobAccessConditions{
+			ModifiedAccessConditions: azblob.ModifiedAccessConditions{
+				IfNoneMatch: azblob.ETagAny,
+			},
+		},
+	); err != nil && !isStorageError(err, azblob.ServiceCodeBlobAlreadyExists) {
+		return fmt.Errorf("error creating marker for event %s: %s", id, err)
+	}
+
+	props, err := markerURL.GetProperties(ctx, azblob.BlobAccessConditions{})
+	if err != nil {
+		return fmt.Errorf("error reading marker for event %s: %s", id, err)
+	}
+	if props.NewMetadata()[processedMetadataKey] == "true" {
+		log.WithField(
+			"id", id,
+		).Debug("event was already processed by a replica; skipping")
+		return nil
+	}
+
+	// The lease is only acquired if the marker is unchanged since it was
+	// found not to have been processed
+	lease, err := markerURL.AcquireLease(
+		ctx,
+		"",
+		int32(c.leaseDuration/time.Second),
+		azblob.ModifiedAccessConditions{IfMatch: props.ETag()},
+	)
+	if isStorageError(err, azblob.ServiceCodeLeaseAlreadyPresent) ||
+		isStorageError(err, azblob.ServiceCodeConditionNotMet) {
+		log.WithField(
+			"id", id,
+		).Debug("event was claimed by another replica")
+		return errClaimed
+	}
+	if err != nil {
+		return fmt.Errorf("error leasing marker for event %s: %s", id, err)
+	}
+	leaseID := lease.LeaseID()
+
+	doneCh := make(chan struct{})
+	go c.renew(markerURL.BlobURL, id, leaseID, doneCh)
+
+	err = fn()
+	close(doneCh)
+	if err == nil {
+		if _, err := markerURL.SetMetadata(
+			ctx,
+			azblob.Metadata{processedMetadataKey: "true"},
+			azblob.BlobAccessConditions{
+				LeaseAccessConditions: azblob.LeaseAccessConditions{
+					LeaseID: leaseID,
+				},
+			},
+		); err != nil {
+			log.WithField(
+				"id", id,
+			).WithField(
+				"error", err,
+			).Error("error marking event as processed")
+		}
+	}
+	if _, relErr := markerURL.ReleaseLease(
+		ctx,
+		leaseID,
+		azblob.ModifiedAccessConditions{},
+	); relErr != nil {
+		log.WithField(
+			"id", id,
+		).WithField(
+			"error", relErr,
+		).Warn("error releasing lease on marker")
+	}
+	return err
+}
+
+// renew renews the lease on a marker at half the lease duration until doneCh
+// is closed.
+func (c *coordinator) renew(
+	markerURL azblob.BlobURL,
+	id string,
+	leaseID string,
+	doneCh chan struct{},
+) {
+	ticker := time.NewTicker(c.leaseDuration / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-doneCh:
+			return
+		case <-ticker.C:
+			if _, err := markerURL.RenewLease(
+				context.Background(),
+				leaseID,
+				azblob.ModifiedAccessConditions{},
+			); err != nil {
+				log.WithField(
+					"id", id,
+				).WithField(
+					"error", err,
+				).Warn("error renewing lease on marker")
+			}
+		}
+	}
+}
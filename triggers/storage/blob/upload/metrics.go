@@ -0,0 +1,11 @@
+package main
+
+import "expvar"
+
+// Metrics are published using expvar and are served by the event listener at
+// /metrics.
+var (
+	// rejectedEvents counts events rejected by the allowlist, keyed by the
+	// attribute (account or topic) that was not allowed.
+	rejectedEvents = expvar.NewMap("rejectedEvents")
+)
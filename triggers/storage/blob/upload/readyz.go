@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const runtimeDialTimeout = time.Second
+
+type readiness struct {
+	Ready    bool   `json:"ready"`
+	Reason   string `json:"reason,omitempty"`
+	InFlight int64  `json:"inFlight"`
+}
+
+// readyz reports whether the trigger is ready to accept events. It is not
+// ready if the faasaf runtime is not accepting connections or if the number
+// of events awaiting a response from the runtime has reached the configured
+// maximum (maxInFlight).
+func (s *server) readyz(w http.ResponseWriter, _ *http.Request) {
+	status := readiness{
+		Ready:    true,
+		InFlight: atomic.LoadInt64(&s.inFlight),
+	}
+	if conn, err := net.DialTimeout(
+		"tcp",
+		s.runtimeAddress,
+		runtimeDialTimeout,
+	); err != nil {
+		status.Ready = false
+		status.Reason = fmt.Sprintf("the faasaf runtime is unreachable: %s", err)
+	} else {
+		conn.Close()
+		if s.maxInFlight > 0 && status.InFlight >= s.maxInFlight {
+			status.Ready = false
+			status.Reason = "the maximum number of in-flight events was reached"
+		}
+	}
+
+	statusCode := http.StatusOK
+	if !status.Ready {
+		statusCode = http.StatusServiceUnavailable
+		log.WithField(
+			"reason", status.Reason,
+		).Debug("not ready")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.WithField(
+			"error", err,
+		).Error("error writing /readyz response")
+	}
+}
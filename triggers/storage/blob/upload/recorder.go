@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const redacted = "REDACTED"
+
+// redactedHeaders are request headers that may carry secrets and are never
+// recorded.
+var redactedHeaders = []string{
+	"Authorization",
+	"Aeg-Sas-Key",
+	"Aeg-Sas-Token",
+	"Cookie",
+}
+
+// recording is a single recorded request. Recordings are written to the
+// recording file one per line.
+type recording struct {
+	Time   time.Time   `json:"time"`
+	Route  string      `json:"route"`
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body"`
+}
+
+// recorder records requests received by the event listener so that they can
+// later be replayed using the replay command.
+type recorder struct {
+	mutex   sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func newRecorder(path string) (*recorder, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	log.WithField(
+		"recordFile", path,
+	).Info("recording received events")
+	return &recorder{
+		file:    file,
+		encoder: json.NewEncoder(file),
+	}, nil
+}
+
+// record returns a handler that records each request before passing it to
+// the given handler.
+func (r *recorder) record(rt *route, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		bodyBytes, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+
+		header := http.Header{}
+		for key, vals := range req.Header {
+			header[key] = vals
+		}
+		for _, key := range redactedHeaders {
+			if header.Get(key) != "" {
+				header.Set(key, redacted)
+			}
+		}
+		u := *req.URL
+		if query := u.Query(); query.Get("key") != "" {
+			query.Set("key", redacted)
+			u.RawQuery = query.Encode()
+		}
+
+		r.mutex.Lock()
+		err = r.encoder.Encode(recording{
+			Time:   time.Now().UTC(),
+			Route:  rt.name,
+			Method: req.Method,
+			URL:    u.RequestURI(),
+			Header: header,
+			Body:   string(bodyBytes),
+		})
+		r.mutex.Unlock()
+		if err != nil {
+			log.WithField(
+				"error", err,
+			).Error("error recording request")
+		}
+
+		handler(w, req)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/faasaf/frameworks/trigger"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var replayCommand = cli.Command{
+	Name:      "replay",
+	Usage:     "replay recorded events against a local faasaf runtime",
+	ArgsUsage: "RECORD_FILE",
+	Flags: append(
+		[]cli.Flag{
+			cli.Float64Flag{
+				Name:  "speed",
+				Value: 1,
+				Usage: "replay at the given multiple of the original pace; 0 " +
+					"replays without delay",
+			},
+		},
+		commonFlags...,
+	),
+	Action: replay,
+}
+
+// replay feeds recorded requests through the same parsing and mapping as the
+// event listener and delegates the resulting contexts to a local runtime,
+// reporting the outcome of each.
+func replay(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("a single record file must be specified")
+	}
+	speed := c.Float64("speed")
+	if speed < 0 {
+		return errors.New("the replay speed must not be negative")
+	}
+
+	cfg, err := setUpCommand(c)
+	if err != nil {
+		return err
+	}
+	routes, err := newRoutes(cfg)
+	if err != nil {
+		return err
+	}
+	// Secrets are redacted from recordings
+	for _, rt := range routes {
+		rt.secret = ""
+	}
+
+	ctxCh := make(chan trigger.ContextWrapper)
+	go serveRuntime(ctxCh, c.Int("runtime-port"))
+	// Buffered so that errors reported while handling a request can be
+	// collected once the handler has returned
+	errCh := make(chan error, 16)
+	handler := (&server{
+		name:      name,
+		routes:    routes,
+		allowlist: newAllowlist(cfg),
+		ctxCh:     ctxCh,
+		errCh:     errCh,
+	}).router()
+
+	file, err := os.Open(c.Args().First())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+
+	var passed, failed int
+	var prevTime time.Time
+	for i := 1; ; i++ {
+		rec := recording{}
+		if err := decoder.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("error reading recording %d: %s", i, err)
+		}
+
+		if speed > 0 && !prevTime.IsZero() {
+			time.Sleep(time.Duration(float64(rec.Time.Sub(prevTime)) / speed))
+		}
+		prevTime = rec.Time
+
+		req, err := http.NewRequest(rec.Method, rec.URL, strings.NewReader(rec.Body))
+		if err != nil {
+			return fmt.Errorf("error reading recording %d: %s", i, err)
+		}
+		req.Header = rec.Header
+
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+
+		reasons := []string{}
+		for drained := false; !drained; {
+			select {
+			case err := <-errCh:
+				reasons = append(reasons, err.Error())
+			default:
+				drained = true
+			}
+		}
+
+		result := "PASS"
+		if res.Code == http.StatusOK {
+			passed++
+		} else {
+			result = "FAIL"
+			failed++
+		}
+		fmt.Printf(
+			"%s %d %s route=%s status=%d %s\n",
+			result,
+			i,
+			rec.Time.Format(time.RFC3339Nano),
+			rec.Route,
+			res.Code,
+			strings.Join(reasons, "; "),
+		)
+	}
+
+	fmt.Printf("%d passed, %d failed\n", passed, failed)
+	if failed > 0 {
+		return cli.NewExitError("", 1)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/faasaf/frameworks/common"
+)
+
+// route describes a single path on which events are received along with the
+// filter, context key mapping and secret that apply to events received on
+// that path. Routes permit a single trigger process to serve several Event
+// Grid subscriptions.
+type route struct {
+	name                string
+	path                string
+	secret              string
+	eventTypes          []string
+	subjectBeginsWith   string
+	subjectEndsWith     string
+	blobURLContextKey   string
+	accountContextKey   string
+	containerContextKey string
+	blobPathContextKey  string
+}
+
+// newRoutes builds routes from configuration. If the routes setting is not
+// specified, a single route is built from top-level settings and mounted at
+// "/". Otherwise, routes is a comma-delimited list of route names and each
+// named route is configured using settings prefixed with "route.<name>.".
+func newRoutes(cfg config) ([]*route, error) {
+	names := splitList(cfg.GetSetting("routes", ""))
+	if len(names) == 0 {
+		rt := newRoute(cfg, "default", "")
+		rt.path = "/"
+		return []*route{rt}, nil
+	}
+	routes := make([]*route, len(names))
+	paths := map[string]string{}
+	for i, name := range names {
+		rt := newRoute(cfg, name, fmt.Sprintf("route.%s.", name))
+		if rt.path == "" {
+			return nil, fmt.Errorf(
+				`the path for route "%s" (route.%s.path) was not specified`,
+				name,
+				name,
+			)
+		}
+		if !strings.HasPrefix(rt.path, "/") {
+			return nil, fmt.Errorf(
+				`the path "%s" for route "%s" does not begin with "/"`,
+				rt.path,
+				name,
+			)
+		}
+		if otherName, ok := paths[rt.path]; ok {
+			return nil, fmt.Errorf(
+				`routes "%s" and "%s" both specify path "%s"`,
+				otherName,
+				name,
+				rt.path,
+			)
+		}
+		paths[rt.path] = name
+		routes[i] = rt
+	}
+	return routes, nil
+}
+
+func newRoute(cfg config, name, prefix string) *route {
+	rt := &route{
+		name:                name,
+		path:                cfg.GetSetting(prefix+"path", ""),
+		secret:              cfg.GetSetting(prefix+"secret", ""),
+		eventTypes:          splitList(cfg.GetSetting(prefix+"eventTypes", "")),
+		subjectBeginsWith:   cfg.GetSetting(prefix+"subjectBeginsWith", ""),
+		subjectEndsWith:     cfg.GetSetting(prefix+"subjectEndsWith", ""),
+		blobURLContextKey:   cfg.GetSetting(prefix+"blobUrlContextKey", ""),
+		accountContextKey:   cfg.GetSetting(prefix+"accountContextKey", ""),
+		containerContextKey: cfg.GetSetting(prefix+"containerContextKey", ""),
+		blobPathContextKey:  cfg.GetSetting(prefix+"blobPathContextKey", ""),
+	}
+	log.WithField(
+		"route", rt.name,
+	).WithField(
+		"path", rt.path,
+	).WithField(
+		"eventTypes", rt.eventTypes,
+	).WithField(
+		"subjectBeginsWith", rt.subjectBeginsWith,
+	).WithField(
+		"subjectEndsWith", rt.subjectEndsWith,
+	).WithField(
+		"blobUrlContextKey", rt.blobURLContextKey,
+	).WithField(
+		"accountContextKey", rt.accountContextKey,
+	).WithField(
+		"containerContextKey", rt.containerContextKey,
+	).WithField(
+		"blobPathContextKey", rt.blobPathContextKey,
+	).Debug("route configured")
+	return rt
+}
+
+// authorize verifies that a request carries the route's secret in the "key"
+// query parameter. Routes without a secret accept all requests.
+func (rt *route) authorize(r *http.Request) error {
+	if rt.secret == "" {
+		return nil
+	}
+	key := r.URL.Query().Get("key")
+	if subtle.ConstantTimeCompare([]byte(key), []byte(rt.secret)) != 1 {
+		return errors.New("request did not include a valid key")
+	}
+	return nil
+}
+
+// accepts returns a bool indicating whether the given event passes the
+// route's filter.
+func (rt *route) accepts(evt event) bool {
+	if len(rt.eventTypes) > 0 {
+		var found bool
+		for _, eventType := range rt.eventTypes {
+			if evt.EventType == eventType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return strings.HasPrefix(evt.Subject, rt.subjectBeginsWith) &&
+		strings.HasSuffix(evt.Subject, rt.subjectEndsWith)
+}
+
+// newContext builds a context for the blob at the given URL, populated
+// according to the route's context key mapping.
+func (rt *route) newContext(blobURL string) (common.Context, error) {
+	matches := blobURLRegex.FindStringSubmatch(blobURL)
+	if len(matches) == 0 {
+		return nil, fmt.Errorf(
+			"blob URL is not a valid Azure Storage URL: %s",
+			blobURL,
+		)
+	}
+
+	ctx := common.NewContext()
+
+	if rt.blobURLContextKey != "" {
+		log.WithField(
+			"key", rt.blobURLContextKey,
+		).WithField(
+			"value", blobURL,
+		).Debug("updating context")
+		ctx.Set(rt.blobURLContextKey, blobURL)
+	}
+
+	if rt.accountContextKey != "" {
+		log.WithField(
+			"key", rt.accountContextKey,
+		).WithField(
+			"value", matches[1],
+		).Debug("updating context")
+		ctx.Set(rt.accountContextKey, matches[1])
+	}
+
+	if rt.containerContextKey != "" {
+		log.WithField(
+			"key", rt.containerContextKey,
+		).WithField(
+			"value", matches[2],
+		).Debug("updating context")
+		ctx.Set(rt.containerContextKey, matches[2])
+	}
+
+	if rt.blobPathContextKey != "" {
+		log.WithField(
+			"key", rt.blobPathContextKey,
+		).WithField(
+			"value", matches[3],
+		).Debug("updating context")
+		ctx.Set(rt.blobPathContextKey, matches[3])
+	}
+
+	return ctx, nil
+}
+
+// splitList splits a comma-delimited setting into its non-empty, trimmed
+// elements.
+func splitList(str string) []string {
+	list := []string{}
+	for _, token := range strings.Split(str, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			list = append(list, token)
+		}
+	}
+	return list
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"expvar"
 	"net/http"
 
 	"github.com/gorilla/mux"
@@ -9,6 +10,14 @@ import (
 func (s *server) router() *mux.Router {
 	r := mux.NewRouter()
 	r.StrictSlash(true)
-	r.HandleFunc("/", s.handleEvent).Methods(http.MethodPost)
+	for _, rt := range s.routes {
+		handler := s.handleEvent(rt)
+		if s.recorder != nil {
+			handler = s.recorder.record(rt, handler)
+		}
+		r.HandleFunc(rt.path, handler).Methods(http.MethodPost)
+	}
+	r.HandleFunc("/readyz", s.readyz).Methods(http.MethodGet)
+	r.Handle("/metrics", expvar.Handler()).Methods(http.MethodGet)
 	return r
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/faasaf/frameworks/common"
+	"github.com/faasaf/frameworks/trigger"
+)
+
+// serveRuntime delegates each context received on ctxCh to the faasaf
+// runtime listening on the given port, in the same manner as the trigger
+// framework. It permits commands other than the trigger itself to drive a
+// local runtime.
+func serveRuntime(ctxCh chan trigger.ContextWrapper, runtimePort int) {
+	for ctxWrapper := range ctxCh {
+		go func(ctxWrapper trigger.ContextWrapper) {
+			res, err := postToRuntime(runtimePort, ctxWrapper.GetContext())
+			if err != nil {
+				ctxWrapper.ErrC() <- err
+				return
+			}
+			ctxWrapper.ResC() <- res
+		}(ctxWrapper)
+	}
+}
+
+func postToRuntime(runtimePort int, ctx common.Context) (common.Context, error) {
+	log.Debug("delegating further processing to the faasaf runtime")
+	bodyBytes, err := json.Marshal(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling context: %s", err)
+	}
+	res, err := http.Post(
+		fmt.Sprintf("http://localhost:%d", runtimePort),
+		"application/json",
+		bytes.NewBuffer(bodyBytes),
+	)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"error delegating further processing to the faasaf runtime: %s",
+			err,
+		)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf(
+			"the faasaf runtime returned status code: %d",
+			res.StatusCode,
+		)
+	}
+	bodyBytes, err = ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %s", err)
+	}
+	resCtx := common.NewContext()
+	if err := json.Unmarshal(bodyBytes, resCtx); err != nil {
+		return nil, fmt.Errorf("error unmarshaling response: %s", err)
+	}
+	return resCtx, nil
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
 	"regexp"
+	"strconv"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/faasaf/frameworks/trigger"
@@ -14,14 +18,91 @@ var blobURLRegex = regexp.MustCompile(
 )
 
 type server struct {
-	name                string
-	port                int
-	blobURLContextKey   string
-	accountContextKey   string
-	containerContextKey string
-	blobPathContextKey  string
-	ctxCh               chan trigger.ContextWrapper
-	errCh               chan error
+	name           string
+	bindAddress    string
+	socket         string
+	runtimeAddress string
+	maxInFlight    int64
+	inFlight       int64
+	routes         []*route
+	allowlist      *allowlist
+	recorder       *recorder
+	batcher        *batcher
+	coordinator    *coordinator
+	ctxCh          chan trigger.ContextWrapper
+	errCh          chan error
+}
+
+func newServer(cfg config) (*server, error) {
+	// The event listener listens on a unix socket (eventSocket), on a
+	// specific address (eventBindAddress) or on the given port on all
+	// interfaces (eventPort), in that order of precedence
+	socket := cfg.GetSetting("eventSocket", "")
+	bindAddress := cfg.GetSetting("eventBindAddress", "")
+	if socket == "" && bindAddress == "" {
+		portStr := cfg.GetSetting("eventPort", "")
+		if portStr == "" {
+			return nil, errors.New(
+				"the event listener port (eventPort), bind address " +
+					"(eventBindAddress) or unix socket (eventSocket) was not " +
+					"specified",
+			)
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return nil, fmt.Errorf(
+				`the specified listener port "%s" could not be pased as an integer`,
+				portStr,
+			)
+		}
+		bindAddress = fmt.Sprintf(":%d", port)
+	}
+
+	maxInFlightStr := cfg.GetSetting("maxInFlight", "0")
+	maxInFlight, err := strconv.ParseInt(maxInFlightStr, 10, 64)
+	if err != nil || maxInFlight < 0 {
+		return nil, fmt.Errorf(
+			`the specified maximum in-flight events "%s" is not a `+
+				`non-negative integer`,
+			maxInFlightStr,
+		)
+	}
+
+	routes, err := newRoutes(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var rec *recorder
+	if recordFile := cfg.GetSetting("recordFile", ""); recordFile != "" {
+		if rec, err = newRecorder(recordFile); err != nil {
+			return nil, err
+		}
+	}
+
+	batcher, err := newBatcher(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	coordinator, err := newCoordinator(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &server{
+		name:        name,
+		bindAddress: bindAddress,
+		socket:      socket,
+		// This should agree with the trigger's --runtime-port flag
+		runtimeAddress: cfg.GetSetting("runtimeAddress", "localhost:8080"),
+		maxInFlight:    maxInFlight,
+		routes:         routes,
+		allowlist:      newAllowlist(cfg),
+		recorder:       rec,
+		batcher:        batcher,
+		coordinator:    coordinator,
+	}, nil
 }
 
 func (s *server) Run(
@@ -30,9 +111,28 @@ func (s *server) Run(
 ) error {
 	s.ctxCh = ctxCh
 	s.errCh = errCh
-	bindAddress := fmt.Sprintf(":%d", s.port)
-	log.WithField(
-		"bindAddress", bindAddress,
-	).Info("listening for events only")
-	return http.ListenAndServe(bindAddress, s.router())
+	if s.batcher != nil {
+		s.batcher.ctxCh = ctxCh
+	}
+	var listener net.Listener
+	var err error
+	if s.socket != "" {
+		// Remove any socket left behind by a previous process
+		if err = os.Remove(s.socket); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		log.WithField(
+			"socket", s.socket,
+		).Info("listening for events only")
+		listener, err = net.Listen("unix", s.socket)
+	} else {
+		log.WithField(
+			"bindAddress", s.bindAddress,
+		).Info("listening for events only")
+		listener, err = net.Listen("tcp", s.bindAddress)
+	}
+	if err != nil {
+		return err
+	}
+	return http.Serve(listener, s.router())
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+
+	"github.com/Azure/azure-storage-blob-go/2018-03-28/azblob"
+	log "github.com/Sirupsen/logrus"
+)
+
+// newServiceURL returns a URL for the blob service of the configured storage
+// account. The blob endpoint defaults to the account's public endpoint but
+// may be overridden (blobEndpoint), e.g. to use a local storage emulator.
+func newServiceURL(cfg config) (azblob.ServiceURL, error) {
+	accountName := cfg.GetSetting("account", "")
+	if accountName == "" {
+		return azblob.ServiceURL{}, errors.New(
+			"the azure storage account (account) was not specified",
+		)
+	}
+
+	accessKey := cfg.GetSetting("accessKey", "")
+	if accessKey == "" {
+		return azblob.ServiceURL{}, errors.New(
+			"the azure storage access key (accessKey) was not specified",
+		)
+	}
+
+	endpoint := cfg.GetSetting(
+		"blobEndpoint",
+		fmt.Sprintf("https://%s.blob.core.windows.net", accountName),
+	)
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return azblob.ServiceURL{}, fmt.Errorf(
+			`the blob endpoint "%s" could not be parsed: %s`,
+			endpoint,
+			err,
+		)
+	}
+
+	credential, err := azblob.NewSharedKeyCredential(accountName, accessKey)
+	if err != nil {
+		return azblob.ServiceURL{}, err
+	}
+
+	log.WithField(
+		"account", accountName,
+	).WithField(
+		"blobEndpoint", endpoint,
+	).Info("Azure storage configured")
+
+	return azblob.NewServiceURL(
+		*endpointURL,
+		azblob.NewPipeline(credential, azblob.PipelineOptions{}),
+	), nil
+}
+
+// isStorageError returns a bool indicating whether err is a storage error
+// with the given service code.
+func isStorageError(err error, code azblob.ServiceCodeType) bool {
+	stgErr, ok := err.(azblob.StorageError)
+	return ok && stgErr.ServiceCode() == code
+}
+
+// listBlobs returns the names of all blobs in the container that begin with
+// the given prefix, in lexicographical order.
+func listBlobs(
+	ctx context.Context,
+	containerURL azblob.ContainerURL,
+	prefix string,
+) ([]string, error) {
+	names := []string{}
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		res, err := containerURL.ListBlobsFlatSegment(
+			ctx,
+			marker,
+			azblob.ListBlobsSegmentOptions{Prefix: prefix},
+		)
+		if err != nil {
+			return nil, err
+		}
+		for _, blob := range res.Segment.BlobItems {
+			names = append(names, blob.Name)
+		}
+		marker = res.NextMarker
+	}
+	return names, nil
+}
+
+// downloadBlob returns the entire contents of a blob.
+func downloadBlob(ctx context.Context, blobURL azblob.BlobURL) ([]byte, error) {
+	res, err := blobURL.Download(
+		ctx,
+		0,
+		azblob.CountToEnd,
+		azblob.BlobAccessConditions{},
+		false,
+	)
+	if err != nil {
+		return nil, err
+	}
+	body := res.Body(azblob.RetryReaderOptions{})
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
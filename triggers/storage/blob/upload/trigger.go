@@ -1,9 +1,8 @@
 package main
 
 import (
-	"errors"
 	"fmt"
-	"strconv"
+	"os"
 
 	"github.com/faasaf/frameworks/trigger"
 )
@@ -13,43 +12,43 @@ const name = "azure-storage-upload"
 // Value is injected by the build
 var version string
 
+// source is a source of events that trips the trigger.
+type source interface {
+	Run(ctxCh chan trigger.ContextWrapper, errCh chan error) error
+}
+
 func main() {
 
-	var srvr *server
+	if runCommand(os.Args) {
+		return
+	}
+
+	var src source
 
 	trigger.Run(
 		name,
 		version,
 		"A FaaSAF trigger that is tripped when a blob is uploaded to Azure Storage",
 		func(cfg trigger.Config) error { // Initializations
-			portStr := cfg.GetSetting("eventPort", "")
-			if portStr == "" {
-				return errors.New(
-					"the event listener port (eventPort) was not specified",
+			var err error
+			switch sourceName := cfg.GetSetting("source", "eventGrid"); sourceName {
+			case "eventGrid":
+				src, err = newServer(cfg)
+			case "changeFeed":
+				src, err = newChangeFeedSource(cfg)
+			case "analyticsLogs":
+				src, err = newAnalyticsLogsSource(cfg)
+			default:
+				err = fmt.Errorf(
+					`the specified trigger source "%s" is not one of eventGrid, `+
+						`changeFeed or analyticsLogs`,
+					sourceName,
 				)
 			}
-
-			port, err := strconv.Atoi(portStr)
-			if err != nil {
-				return fmt.Errorf(
-					`the specified listener port "%s" could not be pased as an integer`,
-					portStr,
-				)
-			}
-
-			srvr = &server{
-				name:                name,
-				port:                port,
-				blobURLContextKey:   cfg.GetSetting("blobUrlContextKey", ""),
-				accountContextKey:   cfg.GetSetting("accountContextKey", ""),
-				containerContextKey: cfg.GetSetting("containerContextKey", ""),
-				blobPathContextKey:  cfg.GetSetting("blobPathContextKey", ""),
-			}
-
-			return nil
+			return err
 		},
 		func(ctxCh chan trigger.ContextWrapper, errCh chan error) { // Actual functionality
-			if err := srvr.Run(ctxCh, errCh); err != nil {
+			if err := src.Run(ctxCh, errCh); err != nil {
 				errCh <- err
 			}
 		},